@@ -0,0 +1,75 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package versioner
+
+import (
+	"io"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/fs"
+	"github.com/syncthing/syncthing/lib/logger"
+)
+
+var l = logger.DefaultLogger.NewFacility("versioner", "File versioning")
+
+// Factory is the signature of the constructor function stashed in the
+// Factories map below.
+type Factory func(folderID string, filesystem fs.Filesystem, params map[string]string) Versioner
+
+// Factories is the map of known versioner types, keyed by the name used in
+// the folder configuration (e.g. "trashcan", "dedup").
+var Factories = map[string]Factory{}
+
+// Versioner is the interface implemented by all file versioning backends.
+type Versioner interface {
+	// Archive moves the named file away to a version archive. If this
+	// function returns nil, the named file does not exist any more (has
+	// been archived).
+	Archive(filePath string) error
+	// Serve runs any background work the versioner does itself until
+	// Stop is called. The versioners in this package register their
+	// periodic cleanout with DefaultScheduler when constructed, so
+	// their Serve returns at once.
+	Serve()
+	// Stop terminates the versioner's background maintenance; for the
+	// versioners in this package it deregisters their cleanout from
+	// DefaultScheduler.
+	Stop()
+
+	// List returns every archived version whose original path starts
+	// with prefix ("" lists everything).
+	List(prefix string) ([]FileVersion, error)
+	// Get returns the contents of the version of filePath that was
+	// archived at versionTime. The caller must Close the result.
+	Get(filePath string, versionTime time.Time) (io.ReadCloser, error)
+	// Restore moves the archived version of filePath taken at
+	// versionTime back into the folder, overwriting whatever is there
+	// now. If a file currently exists at filePath it is archived
+	// first, so a Restore can itself be undone.
+	Restore(filePath string, versionTime time.Time) error
+}
+
+// erroringVersioner is returned in place of a functional Versioner when
+// construction requested a safety property (e.g. encrypt=true) that
+// could not actually be set up. Every operation fails closed instead of
+// silently falling back to something insecure, such as archiving in
+// plaintext.
+type erroringVersioner struct {
+	err error
+}
+
+func (e *erroringVersioner) Archive(filePath string) error { return e.err }
+func (e *erroringVersioner) Serve()                        {}
+func (e *erroringVersioner) Stop()                         {}
+
+func (e *erroringVersioner) List(prefix string) ([]FileVersion, error) { return nil, e.err }
+
+func (e *erroringVersioner) Get(filePath string, versionTime time.Time) (io.ReadCloser, error) {
+	return nil, e.err
+}
+
+func (e *erroringVersioner) Restore(filePath string, versionTime time.Time) error { return e.err }
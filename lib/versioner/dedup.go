@@ -0,0 +1,519 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package versioner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/fs"
+	"github.com/syncthing/syncthing/lib/osutil"
+)
+
+func init() {
+	Factories["dedup"] = NewDedup
+}
+
+const (
+	dedupObjectsDir = "objects"
+	dedupRefsDir    = "refs"
+)
+
+// dedupManifest is the small JSON sidecar written alongside each
+// archived version. It records enough metadata to restore the
+// original file, and lets cleanout decide whether the object it
+// points at is still reachable.
+type dedupManifest struct {
+	Hash            string      `json:"hash"`
+	Mode            os.FileMode `json:"mode"`
+	OriginalModTime time.Time   `json:"originalModTime"`
+	Size            int64       `json:"size"`
+}
+
+// Dedup is a Versioner that stores archived content once per unique
+// hash, under .stversions/objects/<hh>/<hash>, and keeps a small JSON
+// manifest per version under .stversions/refs/<path>/<timestamp>.json
+// pointing at the hash plus original metadata. It is meant for folders
+// with many large, near-duplicate versions (e.g. binary blobs edited
+// slightly), where a plain copy-per-version archive wastes a lot of
+// space.
+type Dedup struct {
+	folderID   string
+	filesystem fs.Filesystem
+	policy     RetentionPolicy
+
+	// gcMut is held across Archive's write of a new object+manifest
+	// pair, and across cleanout's GC pass. Without it, cleanout can run
+	// in the window between storeObject and writeManifest, see no
+	// manifest yet referencing the new object, and delete it as
+	// unreachable - leaving a manifest that Archive goes on to write
+	// pointing at content that's already gone.
+	gcMut sync.Mutex
+}
+
+// NewDedup configures a Dedup versioner. It accepts the same
+// "cleanoutPolicy"/"cleanoutDays"/"maxSizeMiB" params as NewTrashcan.
+func NewDedup(folderID string, filesystem fs.Filesystem, params map[string]string) Versioner {
+	d := &Dedup{
+		folderID:   folderID,
+		filesystem: filesystem,
+		policy:     retentionPolicyFromParams(params),
+	}
+
+	DefaultScheduler.Register(folderID, d.cleanout)
+
+	l.Debugf("instantiated %#v", d)
+	return d
+}
+
+// Archive hashes filePath, stores its content under the object store
+// (if not already present), records a manifest entry for this version,
+// and removes filePath. If this function returns nil, the named file
+// does not exist any more (has been archived).
+func (d *Dedup) Archive(filePath string) error {
+	info, err := d.filesystem.Lstat(filePath)
+	if fs.IsNotExist(err) {
+		l.Debugln("not archiving nonexistent file", filePath)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.IsSymlink() {
+		panic("bug: attempting to version a symlink")
+	}
+
+	if _, err := d.filesystem.Stat(versionsDir); err != nil {
+		if !fs.IsNotExist(err) {
+			return err
+		}
+
+		l.Debugln("creating versions dir", versionsDir)
+		if err := d.filesystem.MkdirAll(versionsDir, 0777); err != nil {
+			return err
+		}
+		d.filesystem.Hide(versionsDir)
+	}
+
+	l.Debugln("archiving", filePath)
+
+	d.gcMut.Lock()
+	hash, err := d.storeObject(filePath)
+	if err != nil {
+		d.gcMut.Unlock()
+		return err
+	}
+
+	ts := time.Now()
+	err = d.writeManifest(filePath, ts, dedupManifest{
+		Hash:            hash,
+		Mode:            info.Mode(),
+		OriginalModTime: info.ModTime(),
+		Size:            info.Size(),
+	})
+	d.gcMut.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return d.filesystem.Remove(filePath)
+}
+
+func (d *Dedup) Serve() {
+}
+
+func (d *Dedup) Stop() {
+	DefaultScheduler.Deregister(d.folderID)
+}
+
+func (d *Dedup) String() string {
+	return fmt.Sprintf("dedup@%p", d)
+}
+
+// List returns every archived version whose original path starts with
+// prefix ("" lists everything).
+func (d *Dedup) List(prefix string) ([]FileVersion, error) {
+	refsRoot := filepath.Join(versionsDir, dedupRefsDir)
+	if _, err := d.filesystem.Lstat(refsRoot); fs.IsNotExist(err) {
+		return nil, nil
+	}
+
+	var versions []FileVersion
+	walkFn := func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+
+		rel, err := filepath.Rel(refsRoot, path)
+		if err != nil {
+			return nil
+		}
+		orig := filepath.Dir(rel)
+		if prefix != "" && !strings.HasPrefix(orig, prefix) {
+			return nil
+		}
+
+		tag := strings.TrimSuffix(filepath.Base(path), ".json")
+		ts, err := time.Parse(TimeFormat, tag)
+		if err != nil {
+			// Not one of our ref files; ignore it.
+			return nil
+		}
+
+		m, err := d.readManifest(path)
+		if err != nil {
+			return err
+		}
+
+		versions = append(versions, FileVersion{
+			ArchivePath:  path,
+			OriginalPath: orig,
+			ModTime:      ts,
+			Size:         m.Size,
+		})
+		return nil
+	}
+	if err := d.filesystem.Walk(refsRoot, walkFn); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// Get returns the contents of the version of filePath that was
+// archived at versionTime. The caller must Close the result.
+func (d *Dedup) Get(filePath string, versionTime time.Time) (io.ReadCloser, error) {
+	m, err := d.readManifest(d.refPath(filePath, versionTime))
+	if err != nil {
+		return nil, err
+	}
+	return d.filesystem.Open(d.objectPath(m.Hash))
+}
+
+// Restore moves the archived version of filePath taken at versionTime
+// back into the folder, overwriting whatever is there now. If a file
+// currently exists at filePath it is archived first, so a Restore can
+// itself be undone.
+func (d *Dedup) Restore(filePath string, versionTime time.Time) error {
+	refPath := d.refPath(filePath, versionTime)
+	m, err := d.readManifest(refPath)
+	if err != nil {
+		return err
+	}
+
+	src, err := d.filesystem.Open(d.objectPath(m.Hash))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if _, err := d.filesystem.Lstat(filePath); err == nil {
+		if err := d.Archive(filePath); err != nil {
+			return err
+		}
+	} else if !fs.IsNotExist(err) {
+		return err
+	}
+
+	if err := d.filesystem.MkdirAll(filepath.Dir(filePath), 0777); err != nil && !fs.IsExist(err) {
+		return err
+	}
+
+	out, err := d.filesystem.Create(filePath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return d.filesystem.Remove(refPath)
+}
+
+// cleanout asks the configured RetentionPolicy which versions survive,
+// removes the rest (and any directory this leaves empty under refs/),
+// then garbage-collects any object no longer referenced by a
+// surviving ref. It holds gcMut for its entire run, so it can never
+// observe (and garbage-collect) an object an in-flight Archive has
+// stored but not yet written the manifest for.
+func (d *Dedup) cleanout() error {
+	d.gcMut.Lock()
+	defer d.gcMut.Unlock()
+
+	versions, err := d.List("")
+	if err != nil {
+		return err
+	}
+	if versions == nil {
+		return nil
+	}
+
+	keep := make(map[string]struct{})
+	for _, path := range d.policy.Retain(versions) {
+		keep[path] = struct{}{}
+	}
+
+	reachable := make(map[string]struct{})
+	filesInDir := make(map[string]int)
+	for _, v := range versions {
+		dir := filepath.Dir(v.ArchivePath)
+		if _, ok := keep[v.ArchivePath]; ok {
+			filesInDir[dir]++
+			if m, err := d.readManifest(v.ArchivePath); err == nil {
+				reachable[m.Hash] = struct{}{}
+			}
+			continue
+		}
+		d.filesystem.Remove(v.ArchivePath)
+		if _, ok := filesInDir[dir]; !ok {
+			filesInDir[dir] = 0
+		}
+	}
+	for dir, n := range filesInDir {
+		if n == 0 {
+			d.filesystem.Remove(dir)
+		}
+	}
+
+	return d.gcObjects(reachable)
+}
+
+// gcObjects removes every object under the object store whose hash is
+// not present in reachable, along with any directory this leaves
+// empty.
+func (d *Dedup) gcObjects(reachable map[string]struct{}) error {
+	objectsRoot := filepath.Join(versionsDir, dedupObjectsDir)
+	if _, err := d.filesystem.Lstat(objectsRoot); fs.IsNotExist(err) {
+		return nil
+	}
+
+	filesInDir := make(map[string]int)
+	walkFn := func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		hash := filepath.Base(path)
+		dir := filepath.Dir(path)
+		if _, ok := reachable[hash]; ok {
+			filesInDir[dir]++
+			return nil
+		}
+		d.filesystem.Remove(path)
+		if _, ok := filesInDir[dir]; !ok {
+			filesInDir[dir] = 0
+		}
+		return nil
+	}
+	if err := d.filesystem.Walk(objectsRoot, walkFn); err != nil {
+		return err
+	}
+	for dir, n := range filesInDir {
+		if n == 0 {
+			d.filesystem.Remove(dir)
+		}
+	}
+	return nil
+}
+
+// storeObject streams sourcePath through a hash, saving its content
+// under the object store keyed by that hash unless an object with the
+// same hash is already present. It returns the hex-encoded hash.
+func (d *Dedup) storeObject(sourcePath string) (string, error) {
+	src, err := d.filesystem.Open(sourcePath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	tmpPath := filepath.Join(versionsDir, dedupObjectsDir, "tmp-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+	if err := d.filesystem.MkdirAll(filepath.Dir(tmpPath), 0777); err != nil && !fs.IsExist(err) {
+		return "", err
+	}
+	tmp, err := d.filesystem.Create(tmpPath)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), src); err != nil {
+		tmp.Close()
+		d.filesystem.Remove(tmpPath)
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		d.filesystem.Remove(tmpPath)
+		return "", err
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	objectPath := d.objectPath(hash)
+	if _, err := d.filesystem.Lstat(objectPath); err == nil {
+		// Content already stored under this hash.
+		d.filesystem.Remove(tmpPath)
+		return hash, nil
+	} else if !fs.IsNotExist(err) {
+		d.filesystem.Remove(tmpPath)
+		return "", err
+	}
+
+	if err := d.filesystem.MkdirAll(filepath.Dir(objectPath), 0777); err != nil && !fs.IsExist(err) {
+		d.filesystem.Remove(tmpPath)
+		return "", err
+	}
+	if err := osutil.Rename(d.filesystem, tmpPath, objectPath); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+func (d *Dedup) objectPath(hash string) string {
+	return filepath.Join(versionsDir, dedupObjectsDir, hash[:2], hash)
+}
+
+func (d *Dedup) refPath(filePath string, ts time.Time) string {
+	return filepath.Join(versionsDir, dedupRefsDir, filePath, ts.Format(TimeFormat)+".json")
+}
+
+func (d *Dedup) writeManifest(filePath string, ts time.Time, m dedupManifest) error {
+	refPath := d.refPath(filePath, ts)
+	if err := d.filesystem.MkdirAll(filepath.Dir(refPath), 0777); err != nil && !fs.IsExist(err) {
+		return err
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	out, err := d.filesystem.Create(refPath)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(data); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (d *Dedup) readManifest(refPath string) (dedupManifest, error) {
+	f, err := d.filesystem.Open(refPath)
+	if err != nil {
+		return dedupManifest{}, err
+	}
+	defer f.Close()
+
+	var m dedupManifest
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return dedupManifest{}, err
+	}
+	return m, nil
+}
+
+// MigrateTrashcanToDedup converts an existing Trashcan-style versions
+// archive (plain copies under .stversions/<path>~<timestamp>.ext) into
+// the dedup layout, in place. Files already under the dedup layout's
+// own objects/refs directories are left alone, so it is safe to call
+// on a folder that has already been migrated, or migrated partially.
+func MigrateTrashcanToDedup(filesystem fs.Filesystem) error {
+	if _, err := filesystem.Lstat(versionsDir); fs.IsNotExist(err) {
+		return nil
+	}
+
+	d := &Dedup{filesystem: filesystem}
+	objectsPrefix := filepath.Join(versionsDir, dedupObjectsDir)
+	refsPrefix := filepath.Join(versionsDir, dedupRefsDir)
+
+	var toMigrate []string
+	walkFn := func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if path == objectsPrefix || strings.HasPrefix(path, objectsPrefix+string(filepath.Separator)) ||
+			path == refsPrefix || strings.HasPrefix(path, refsPrefix+string(filepath.Separator)) {
+			return nil
+		}
+		toMigrate = append(toMigrate, path)
+		return nil
+	}
+	if err := filesystem.Walk(versionsDir, walkFn); err != nil {
+		return err
+	}
+
+	filesInDir := make(map[string]int)
+	for _, path := range toMigrate {
+		rel, err := filepath.Rel(versionsDir, path)
+		if err != nil {
+			return err
+		}
+
+		orig, tag, ok := UntagFilename(rel)
+		if !ok {
+			// Not a recognizable trashcan version; leave it alone.
+			continue
+		}
+		ts, err := time.Parse(TimeFormat, tag)
+		if err != nil {
+			continue
+		}
+
+		info, err := filesystem.Lstat(path)
+		if err != nil {
+			return err
+		}
+
+		hash, err := d.storeObject(path)
+		if err != nil {
+			return err
+		}
+
+		if err := d.writeManifest(orig, ts, dedupManifest{
+			Hash:            hash,
+			Mode:            info.Mode(),
+			OriginalModTime: info.ModTime(),
+			Size:            info.Size(),
+		}); err != nil {
+			return err
+		}
+
+		if err := filesystem.Remove(path); err != nil {
+			return err
+		}
+
+		dir := filepath.Dir(path)
+		if _, ok := filesInDir[dir]; !ok {
+			filesInDir[dir] = 0
+		}
+	}
+
+	for dir := range filesInDir {
+		filesystem.Remove(dir)
+	}
+
+	return nil
+}
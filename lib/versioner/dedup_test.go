@@ -0,0 +1,155 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package versioner
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/syncthing/syncthing/lib/fs"
+)
+
+func newTestDedup(t *testing.T) (*Dedup, fs.Filesystem) {
+	t.Helper()
+	filesystem := fs.NewFilesystem(fs.FilesystemTypeFake, t.Name())
+	d := NewDedup("folder", filesystem, map[string]string{}).(*Dedup)
+	t.Cleanup(d.Stop)
+	return d, filesystem
+}
+
+func writeFile(t *testing.T, filesystem fs.Filesystem, name, content string) {
+	t.Helper()
+	f, err := filesystem.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDedupArchiveListGetRestore(t *testing.T) {
+	d, filesystem := newTestDedup(t)
+
+	writeFile(t, filesystem, "foo.txt", "hello")
+	if err := d.Archive("foo.txt"); err != nil {
+		t.Fatalf("Archive: %v", err)
+	}
+
+	versions, err := d.List("")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(versions) != 1 {
+		t.Fatalf("expected 1 version, got %d", len(versions))
+	}
+
+	rc, err := d.Get("foo.txt", versions[0].ModTime)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	content, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("reading archived content: %v", err)
+	}
+	if string(content) != "hello" {
+		t.Fatalf("got archived content %q, want %q", content, "hello")
+	}
+
+	if err := d.Restore("foo.txt", versions[0].ModTime); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	f, err := filesystem.Open("foo.txt")
+	if err != nil {
+		t.Fatalf("opening restored file: %v", err)
+	}
+	restored, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("reading restored file: %v", err)
+	}
+	if string(restored) != "hello" {
+		t.Fatalf("got restored content %q, want %q", restored, "hello")
+	}
+}
+
+// TestDedupArchiveRaceWithCleanout exercises Archive and cleanout
+// running concurrently, the way the background Scheduler can run a
+// cleanout while a sync is actively deleting (and so archiving) files.
+// Before gcMut serialized the two, cleanout could walk refs/ in the
+// gap between Archive writing the object and writing its manifest,
+// conclude the new object was unreferenced, and delete it out from
+// under the in-flight Archive.
+func TestDedupArchiveRaceWithCleanout(t *testing.T) {
+	d, filesystem := newTestDedup(t)
+
+	for i := 0; i < 20; i++ {
+		writeFile(t, filesystem, "foo.txt", "hello world")
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := d.Archive("foo.txt"); err != nil {
+				t.Errorf("Archive: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := d.cleanout(); err != nil {
+				t.Errorf("cleanout: %v", err)
+			}
+		}()
+		wg.Wait()
+	}
+
+	versions, err := d.List("")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	for _, v := range versions {
+		rc, err := d.Get("foo.txt", v.ModTime)
+		if err != nil {
+			t.Fatalf("Get(%v): %v (manifest referenced an object that GC deleted out from under Archive)", v.ModTime, err)
+		}
+		rc.Close()
+	}
+}
+
+func TestMigrateTrashcanToDedupSkipsOnlyItsOwnDirs(t *testing.T) {
+	filesystem := fs.NewFilesystem(fs.FilesystemTypeFake, t.Name())
+	if err := filesystem.MkdirAll(versionsDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// A trashcan-archived file whose original name happens to share a
+	// prefix with the dedup layout's own directories must still be
+	// migrated, not mistaken for dedup's own bookkeeping and skipped.
+	writeFile(t, filesystem, versionsDir+"/objects~20200101-000000.txt", "not actually a dedup object")
+
+	if err := MigrateTrashcanToDedup(filesystem); err != nil {
+		t.Fatalf("MigrateTrashcanToDedup: %v", err)
+	}
+
+	if _, err := filesystem.Lstat(versionsDir + "/objects~20200101-000000.txt"); !fs.IsNotExist(err) {
+		t.Fatal("expected the old trashcan-format file to be migrated away, but it's still there")
+	}
+
+	d := &Dedup{filesystem: filesystem}
+	versions, err := d.List("")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(versions) != 1 {
+		t.Fatalf("expected the file to show up as a migrated dedup version, got %d versions", len(versions))
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package versioner
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+
+	"github.com/syncthing/syncthing/lib/fs"
+)
+
+const (
+	saltFile  = ".salt"
+	indexFile = ".index"
+	saltSize  = 16
+
+	// scrypt cost parameters; N=2^15 keeps key derivation under a
+	// second on reasonably modern hardware while staying expensive to
+	// brute force.
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// encryptor transparently encrypts archived file content and
+// obfuscates archived file names for a versioner configured with
+// encrypt=true. The name index that maps an obfuscated name back to
+// its plaintext archived path is itself stored encrypted, so an
+// untrusted node holding nothing but the versions directory learns
+// neither file names nor content.
+type encryptor struct {
+	filesystem fs.Filesystem
+	aead       cipher.AEAD
+	hmacKey    []byte
+
+	mut   sync.Mutex
+	index map[string]string // obfuscated name -> plaintext archived path
+}
+
+// newEncryptor returns nil, nil if params doesn't request encryption
+// (encrypt != "true"). Otherwise it derives a key from params and
+// loads (or initializes) the on-disk salt and name index.
+func newEncryptor(filesystem fs.Filesystem, params map[string]string) (*encryptor, error) {
+	if params["encrypt"] != "true" {
+		return nil, nil
+	}
+
+	passphrase := params["passphrase"]
+	if keyfile := params["keyfile"]; keyfile != "" {
+		data, err := ioutil.ReadFile(keyfile)
+		if err != nil {
+			return nil, fmt.Errorf("reading keyfile: %w", err)
+		}
+		passphrase = strings.TrimSpace(string(data))
+	}
+	if passphrase == "" {
+		return nil, errors.New("encrypt=true requires a passphrase or keyfile")
+	}
+
+	salt, err := loadOrCreateSalt(filesystem)
+	if err != nil {
+		return nil, fmt.Errorf("loading salt: %w", err)
+	}
+
+	// Derive enough key material for both the AEAD key and a separate
+	// HMAC key for name obfuscation, from a single scrypt call.
+	keyMaterial, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize+sha256.Size)
+	if err != nil {
+		return nil, fmt.Errorf("deriving key: %w", err)
+	}
+
+	aead, err := chacha20poly1305.New(keyMaterial[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, err
+	}
+
+	e := &encryptor{
+		filesystem: filesystem,
+		aead:       aead,
+		hmacKey:    keyMaterial[chacha20poly1305.KeySize:],
+	}
+	if err := e.loadIndex(); err != nil {
+		return nil, fmt.Errorf("loading name index: %w", err)
+	}
+	return e, nil
+}
+
+func loadOrCreateSalt(filesystem fs.Filesystem) ([]byte, error) {
+	if err := filesystem.MkdirAll(versionsDir, 0777); err != nil && !fs.IsExist(err) {
+		return nil, err
+	}
+	filesystem.Hide(versionsDir)
+
+	saltPath := filepath.Join(versionsDir, saltFile)
+	if f, err := filesystem.Open(saltPath); err == nil {
+		defer f.Close()
+		return ioutil.ReadAll(f)
+	} else if !fs.IsNotExist(err) {
+		return nil, err
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	out, err := filesystem.Create(saltPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := out.Write(salt); err != nil {
+		out.Close()
+		return nil, err
+	}
+	return salt, out.Close()
+}
+
+// obfuscate returns the HMAC of name, hex-encoded, used as its
+// obfuscated on-disk name.
+func (e *encryptor) obfuscate(name string) string {
+	mac := hmac.New(sha256.New, e.hmacKey)
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// encrypt seals plaintext, binding it to aad via the AEAD's associated
+// data so that ciphertext can't be relocated to a different aad (e.g.
+// a different archived path) and still decrypt successfully. A node
+// that syncs nothing but the versions directory has full filesystem
+// access to its own copy of it, so without this binding it could swap
+// two archived versions' ciphertext on disk and have both decrypt
+// "successfully", just with swapped content.
+func (e *encryptor) encrypt(plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return e.aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func (e *encryptor) decrypt(ciphertext, aad []byte) ([]byte, error) {
+	ns := e.aead.NonceSize()
+	if len(ciphertext) < ns {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:ns], ciphertext[ns:]
+	return e.aead.Open(nil, nonce, sealed, aad)
+}
+
+// register obfuscates archivedPath, records the mapping in the name
+// index (persisting it before returning), and returns the physical
+// on-disk path the caller should write the encrypted content to.
+func (e *encryptor) register(archivedPath string) (string, error) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	obf := e.obfuscate(archivedPath)
+	e.index[obf] = archivedPath
+	if err := e.saveIndexLocked(); err != nil {
+		return "", err
+	}
+	return filepath.Join(versionsDir, obf), nil
+}
+
+// physicalPath returns the on-disk path for a previously registered
+// archivedPath, and whether it is known to the name index.
+func (e *encryptor) physicalPath(archivedPath string) (string, bool) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	obf := e.obfuscate(archivedPath)
+	_, ok := e.index[obf]
+	return filepath.Join(versionsDir, obf), ok
+}
+
+// forget removes archivedPath's entry from the name index, e.g. once
+// the file it names has been deleted during cleanout.
+func (e *encryptor) forget(archivedPath string) error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	obf := e.obfuscate(archivedPath)
+	if _, ok := e.index[obf]; !ok {
+		return nil
+	}
+	delete(e.index, obf)
+	return e.saveIndexLocked()
+}
+
+// entries returns a snapshot of the obfuscated-name -> archived-path
+// index.
+func (e *encryptor) entries() map[string]string {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	out := make(map[string]string, len(e.index))
+	for k, v := range e.index {
+		out[k] = v
+	}
+	return out
+}
+
+func (e *encryptor) loadIndex() error {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	e.index = make(map[string]string)
+
+	f, err := e.filesystem.Open(filepath.Join(versionsDir, indexFile))
+	if fs.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ciphertext, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if len(ciphertext) == 0 {
+		return nil
+	}
+
+	plaintext, err := e.decrypt(ciphertext, []byte(indexFile))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plaintext, &e.index)
+}
+
+// saveIndexLocked persists e.index. The caller must hold e.mut.
+func (e *encryptor) saveIndexLocked() error {
+	data, err := json.Marshal(e.index)
+	if err != nil {
+		return err
+	}
+	ciphertext, err := e.encrypt(data, []byte(indexFile))
+	if err != nil {
+		return err
+	}
+
+	out, err := e.filesystem.Create(filepath.Join(versionsDir, indexFile))
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(ciphertext); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
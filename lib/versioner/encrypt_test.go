@@ -0,0 +1,123 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package versioner
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/syncthing/syncthing/lib/fs"
+)
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	filesystem := fs.NewFilesystem(fs.FilesystemTypeFake, "TestEncryptDecryptRoundTrip")
+
+	e, err := newEncryptor(filesystem, map[string]string{
+		"encrypt":    "true",
+		"passphrase": "correct horse battery staple",
+	})
+	if err != nil {
+		t.Fatalf("newEncryptor: %v", err)
+	}
+
+	plaintext := []byte("hello, archived world")
+	aad := []byte("foo/bar~20200101-000000.txt")
+	ciphertext, err := e.encrypt(plaintext, aad)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if bytes.Contains(ciphertext, plaintext) {
+		t.Fatal("ciphertext contains the plaintext verbatim")
+	}
+
+	got, err := e.decrypt(ciphertext, aad)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("decrypt(encrypt(x)) = %q, want %q", got, plaintext)
+	}
+}
+
+// TestDecryptRejectsSwappedAssociatedData guards against a node that
+// syncs nothing but the versions directory: it has full filesystem
+// access to its own copy of that directory, so it can rename/overwrite
+// one archived version's ciphertext bytes onto another's. Binding the
+// archived path in as AEAD associated data means decrypt must reject
+// the swapped ciphertext instead of happily returning version B's
+// content under version A's name.
+func TestDecryptRejectsSwappedAssociatedData(t *testing.T) {
+	filesystem := fs.NewFilesystem(fs.FilesystemTypeFake, "TestDecryptRejectsSwappedAssociatedData")
+
+	e, err := newEncryptor(filesystem, map[string]string{
+		"encrypt":    "true",
+		"passphrase": "correct horse battery staple",
+	})
+	if err != nil {
+		t.Fatalf("newEncryptor: %v", err)
+	}
+
+	ciphertext, err := e.encrypt([]byte("version A content"), []byte("a~20200101-000000.txt"))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+
+	// An attacker relocates A's ciphertext to decrypt as if it were B.
+	if _, err := e.decrypt(ciphertext, []byte("b~20200101-000000.txt")); err == nil {
+		t.Fatal("decrypt succeeded with a mismatched archived path, associated data is not being checked")
+	}
+}
+
+func TestObfuscateIsDeterministic(t *testing.T) {
+	filesystem := fs.NewFilesystem(fs.FilesystemTypeFake, "TestObfuscateIsDeterministic")
+
+	e, err := newEncryptor(filesystem, map[string]string{
+		"encrypt":    "true",
+		"passphrase": "correct horse battery staple",
+	})
+	if err != nil {
+		t.Fatalf("newEncryptor: %v", err)
+	}
+
+	a := e.obfuscate("foo/bar~20200101-000000.txt")
+	b := e.obfuscate("foo/bar~20200101-000000.txt")
+	if a != b {
+		t.Fatalf("obfuscate is not deterministic: %q != %q", a, b)
+	}
+
+	if c := e.obfuscate("foo/baz~20200101-000000.txt"); c == a {
+		t.Fatal("obfuscate produced the same name for two different paths")
+	}
+}
+
+func TestNewEncryptorWrongPassphraseFailsClosed(t *testing.T) {
+	filesystem := fs.NewFilesystem(fs.FilesystemTypeFake, "TestNewEncryptorWrongPassphraseFailsClosed")
+
+	params := map[string]string{
+		"encrypt":    "true",
+		"passphrase": "correct horse battery staple",
+	}
+
+	e, err := newEncryptor(filesystem, params)
+	if err != nil {
+		t.Fatalf("newEncryptor: %v", err)
+	}
+	if _, err := e.register("some/archived/path~20200101-000000.txt"); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	// Re-opening with the wrong passphrase must fail to load the
+	// already-written, now-undecryptable name index, rather than
+	// quietly starting over with an empty one.
+	wrongParams := map[string]string{
+		"encrypt":    "true",
+		"passphrase": "wrong passphrase entirely",
+	}
+	if _, err := newEncryptor(filesystem, wrongParams); err == nil {
+		t.Fatal("expected newEncryptor to fail with the wrong passphrase, got nil error")
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package versioner
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/fs"
+)
+
+// FileVersion describes one archived version, whether it's being
+// inspected by a RetentionPolicy or returned from Versioner.List.
+// ArchivePath is the version's path under the versions directory;
+// OriginalPath is ArchivePath with the "~timestamp" tag stripped back
+// out, i.e. the path the file lived at in the synced folder.
+type FileVersion struct {
+	ArchivePath  string
+	OriginalPath string
+	ModTime      time.Time
+	Size         int64
+}
+
+// RetentionPolicy decides which archived versions survive a cleanout
+// pass. Retain is handed every archived version currently on disk and
+// returns the subset, identified by FileVersion.ArchivePath, that
+// should be kept. Anything not returned is removed.
+type RetentionPolicy interface {
+	Retain(versions []FileVersion) []string
+}
+
+// newFileVersion builds a FileVersion from a file walked under
+// versionsDir, resolving its original (untagged, de-prefixed) path
+// along the way. Files that don't carry a valid tag are treated as
+// versions of themselves.
+func newFileVersion(path string, info fs.FileInfo) FileVersion {
+	rel, err := filepath.Rel(versionsDir, path)
+	if err != nil {
+		rel = path
+	}
+	orig, _, ok := UntagFilename(rel)
+	if !ok {
+		orig = rel
+	}
+	return FileVersion{
+		ArchivePath:  path,
+		OriginalPath: orig,
+		ModTime:      info.ModTime(),
+		Size:         info.Size(),
+	}
+}
+
+// groupByOriginal buckets versions by the original file they are a
+// version of, preserving per-bucket ordering newest-first.
+func groupByOriginal(versions []FileVersion) map[string][]FileVersion {
+	groups := make(map[string][]FileVersion)
+	for _, v := range versions {
+		groups[v.OriginalPath] = append(groups[v.OriginalPath], v)
+	}
+	for _, g := range groups {
+		sort.Slice(g, func(i, j int) bool {
+			return g[i].ModTime.After(g[j].ModTime)
+		})
+	}
+	return groups
+}
+
+// AgeRetentionPolicy keeps every version newer than MaxAge and discards
+// the rest. MaxAge <= 0 means "keep everything" (cleanout disabled).
+type AgeRetentionPolicy struct {
+	MaxAge time.Duration
+}
+
+func (p *AgeRetentionPolicy) Retain(versions []FileVersion) []string {
+	if p.MaxAge <= 0 {
+		return allPaths(versions)
+	}
+
+	cutoff := time.Now().Add(-p.MaxAge)
+	var keep []string
+	for _, v := range versions {
+		if v.ModTime.After(cutoff) {
+			keep = append(keep, v.ArchivePath)
+		}
+	}
+	return keep
+}
+
+// StaggeredRetentionPolicy thins out versions per original file: every
+// version in the last hour, hourly for the last day, daily for the last
+// week, weekly for the last month, and monthly thereafter.
+type StaggeredRetentionPolicy struct {
+	// Now is used for tests; if zero, time.Now() is used.
+	Now time.Time
+}
+
+func (p *StaggeredRetentionPolicy) Retain(versions []FileVersion) []string {
+	now := p.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	var keep []string
+	for _, group := range groupByOriginal(versions) {
+		keep = append(keep, p.retainGroup(group, now)...)
+	}
+	return keep
+}
+
+func (p *StaggeredRetentionPolicy) retainGroup(versions []FileVersion, now time.Time) []string {
+	// versions is sorted newest-first by groupByOriginal.
+	type bucket struct {
+		until time.Duration
+		round time.Duration
+	}
+	buckets := []bucket{
+		{time.Hour, 0},                            // everything in the last hour
+		{24 * time.Hour, time.Hour},               // hourly for the last day
+		{7 * 24 * time.Hour, 24 * time.Hour},      // daily for the last week
+		{30 * 24 * time.Hour, 7 * 24 * time.Hour}, // weekly for the last month
+		{0, 30 * 24 * time.Hour},                  // monthly thereafter
+	}
+
+	var keep []string
+	seen := make(map[string]struct{}) // one version per (bucket, rounded slot)
+	for _, v := range versions {
+		age := now.Sub(v.ModTime)
+
+		var b bucket
+		for _, candidate := range buckets {
+			if candidate.until == 0 || age < candidate.until {
+				b = candidate
+				break
+			}
+		}
+
+		if b.round == 0 {
+			// Within the last-hour bucket: keep everything.
+			keep = append(keep, v.ArchivePath)
+			continue
+		}
+
+		slot := v.ModTime.Truncate(b.round).Unix()
+		key := strconv.FormatInt(int64(b.round), 10) + ":" + strconv.FormatInt(slot, 10)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		keep = append(keep, v.ArchivePath)
+	}
+	return keep
+}
+
+// SizeCapRetentionPolicy evicts the oldest versions, across all original
+// files, until the total size of the archive is at or below MaxBytes.
+type SizeCapRetentionPolicy struct {
+	MaxBytes int64
+}
+
+func (p *SizeCapRetentionPolicy) Retain(versions []FileVersion) []string {
+	if p.MaxBytes <= 0 {
+		return allPaths(versions)
+	}
+
+	sorted := make([]FileVersion, len(versions))
+	copy(sorted, versions)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ModTime.After(sorted[j].ModTime)
+	})
+
+	// Retained versions must be a newest-first contiguous run: the first
+	// version (in age order) that would overflow the budget, and every
+	// version older than it, are evicted. Skipping past an oversized
+	// version instead of stopping there would evict bytes out of age
+	// order - e.g. discarding a single large new version to make room
+	// for several small old ones, which is not "oldest-first".
+	var total int64
+	var keep []string
+	for _, v := range sorted {
+		if total+v.Size > p.MaxBytes {
+			break
+		}
+		total += v.Size
+		keep = append(keep, v.ArchivePath)
+	}
+	return keep
+}
+
+func allPaths(versions []FileVersion) []string {
+	paths := make([]string, len(versions))
+	for i, v := range versions {
+		paths[i] = v.ArchivePath
+	}
+	return paths
+}
+
+// parseMiB parses a "params" style megabyte value, returning 0 on error.
+func parseMiB(s string) int64 {
+	mib, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return mib * 1024 * 1024
+}
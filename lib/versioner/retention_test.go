@@ -0,0 +1,85 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package versioner
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func fv(path string, age time.Duration, size int64) FileVersion {
+	return FileVersion{
+		ArchivePath:  path,
+		OriginalPath: "foo",
+		ModTime:      time.Now().Add(-age),
+		Size:         size,
+	}
+}
+
+func TestAgeRetentionPolicy(t *testing.T) {
+	versions := []FileVersion{
+		fv("new", time.Minute, 1),
+		fv("old", 48*time.Hour, 1),
+	}
+
+	p := &AgeRetentionPolicy{MaxAge: 24 * time.Hour}
+	keep := p.Retain(versions)
+	if len(keep) != 1 || keep[0] != "new" {
+		t.Fatalf("expected only the new version to survive, got %v", keep)
+	}
+
+	p = &AgeRetentionPolicy{MaxAge: 0}
+	keep = p.Retain(versions)
+	if len(keep) != 2 {
+		t.Fatalf("MaxAge <= 0 should keep everything, got %v", keep)
+	}
+}
+
+func TestSizeCapRetentionPolicyOldestFirst(t *testing.T) {
+	// Newest to oldest: 20MiB, 3MiB, 3MiB, 3MiB, with a 10MiB cap. The
+	// 20MiB version alone already overflows the budget, so nothing can
+	// be retained - keeping any of the smaller, older versions instead
+	// would be evicting the newest bytes to make room for older ones,
+	// which is backwards.
+	const mib = 1024 * 1024
+	versions := []FileVersion{
+		fv("v1", time.Minute, 20*mib),
+		fv("v2", time.Hour, 3*mib),
+		fv("v3", 2*time.Hour, 3*mib),
+		fv("v4", 3*time.Hour, 3*mib),
+	}
+
+	p := &SizeCapRetentionPolicy{MaxBytes: 10 * mib}
+	keep := p.Retain(versions)
+	if len(keep) != 0 {
+		t.Fatalf("expected no versions to fit under the cap, got %v", keep)
+	}
+}
+
+func TestSizeCapRetentionPolicyContiguousPrefix(t *testing.T) {
+	const mib = 1024 * 1024
+	versions := []FileVersion{
+		fv("v1", time.Minute, 3*mib),
+		fv("v2", time.Hour, 3*mib),
+		fv("v3", 2*time.Hour, 3*mib),
+		fv("v4", 3*time.Hour, 3*mib),
+	}
+
+	p := &SizeCapRetentionPolicy{MaxBytes: 10 * mib}
+	keep := p.Retain(versions)
+	sort.Strings(keep)
+	want := []string{"v1", "v2", "v3"}
+	if len(keep) != len(want) {
+		t.Fatalf("got %v, want %v", keep, want)
+	}
+	for i := range want {
+		if keep[i] != want[i] {
+			t.Fatalf("got %v, want %v", keep, want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package versioner
+
+import (
+	"sync"
+	"time"
+)
+
+// maxConcurrentCleanouts bounds how many folders' version archives may
+// be walked for cleanout at the same time.
+const maxConcurrentCleanouts = 4
+
+// cleanupInterval is how often the scheduler sweeps all registered
+// folders for a cleanout.
+const cleanupInterval = 24 * time.Hour
+
+// DefaultScheduler is the Scheduler that versioner constructors (e.g.
+// NewTrashcan) register with.
+var DefaultScheduler = NewScheduler()
+
+// Scheduler drives the periodic cleanout maintenance for every
+// registered folder from a single background goroutine, rather than
+// each Versioner owning its own timer. A scheduled sweep runs up to
+// maxConcurrentCleanouts folders' cleanouts in parallel. This matters for installations
+// with many shared folders: independent per-folder 24h timers all
+// fire within the same minute at startup and thrash the disk.
+type Scheduler struct {
+	mut     sync.Mutex
+	cleanup map[string]func() error // folderID -> cleanout function
+	trigger chan string
+	stop    chan struct{}
+	started bool
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		cleanup: make(map[string]func() error),
+		trigger: make(chan string),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Register adds folderID's cleanout function to the schedule, starting
+// the scheduler's background goroutine on first use. Calling Register
+// again for an already registered folderID replaces its function.
+func (s *Scheduler) Register(folderID string, cleanout func() error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.cleanup[folderID] = cleanout
+	if !s.started {
+		s.started = true
+		go s.serve()
+	}
+}
+
+// Deregister removes folderID from the schedule. It is a no-op if
+// folderID was never registered.
+func (s *Scheduler) Deregister(folderID string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	delete(s.cleanup, folderID)
+}
+
+// CleanoutNow triggers an out-of-schedule cleanout of folderID, e.g. in
+// response to a REST API request. It does not wait for the cleanout to
+// finish. Unlike Register, this may be the first call the scheduler
+// ever sees (e.g. a REST request for a folder with a typoed ID, or a
+// deployment with zero versioned folders yet configured), so it also
+// starts the background goroutine if nothing has registered it yet -
+// otherwise the send below would block forever with nothing around to
+// receive it.
+func (s *Scheduler) CleanoutNow(folderID string) {
+	s.mut.Lock()
+	if !s.started {
+		s.started = true
+		go s.serve()
+	}
+	s.mut.Unlock()
+
+	select {
+	case s.trigger <- folderID:
+	case <-s.stop:
+	}
+}
+
+// Stop terminates the scheduler's background goroutine. It is only
+// meant for tests; a running syncthing process keeps the default
+// scheduler alive for its entire lifetime.
+func (s *Scheduler) Stop() {
+	close(s.stop)
+}
+
+func (s *Scheduler) serve() {
+	l.Debugln(s, "starting")
+	defer l.Debugln(s, "stopping")
+
+	// Do the first sweep one minute after this goroutine starts, i.e.
+	// after the first Register or CleanoutNow call.
+	timer := time.NewTimer(time.Minute)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+
+		case folderID := <-s.trigger:
+			s.cleanoutOne(folderID)
+
+		case <-timer.C:
+			s.cleanoutAll()
+			timer.Reset(cleanupInterval)
+		}
+	}
+}
+
+func (s *Scheduler) cleanoutAll() {
+	s.mut.Lock()
+	fns := make(map[string]func() error, len(s.cleanup))
+	for id, fn := range s.cleanup {
+		fns[id] = fn
+	}
+	s.mut.Unlock()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentCleanouts)
+	for id, fn := range fns {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(id string, fn func() error) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			s.runCleanout(id, fn)
+		}(id, fn)
+	}
+	wg.Wait()
+}
+
+func (s *Scheduler) cleanoutOne(folderID string) {
+	s.mut.Lock()
+	fn, ok := s.cleanup[folderID]
+	s.mut.Unlock()
+	if !ok {
+		return
+	}
+	s.runCleanout(folderID, fn)
+}
+
+func (s *Scheduler) runCleanout(folderID string, fn func() error) {
+	if err := fn(); err != nil {
+		l.Infoln("Cleaning versions for folder", folderID, "-", err)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package versioner
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedulerCleanoutNowRunsRegisteredFolder(t *testing.T) {
+	s := NewScheduler()
+	defer s.Stop()
+
+	called := make(chan struct{}, 1)
+	s.Register("folder1", func() error {
+		called <- struct{}{}
+		return nil
+	})
+
+	s.CleanoutNow("folder1")
+
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("CleanoutNow did not run the registered cleanout function")
+	}
+}
+
+func TestSchedulerDeregisterStopsCleanout(t *testing.T) {
+	s := NewScheduler()
+	defer s.Stop()
+
+	var calls int32
+	s.Register("folder1", func() error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+	s.Deregister("folder1")
+
+	// CleanoutNow for a deregistered (or never-registered) folder must
+	// still return promptly rather than hang.
+	done := make(chan struct{})
+	go func() {
+		s.CleanoutNow("folder1")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("CleanoutNow hung for a deregistered folder")
+	}
+
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Fatalf("expected 0 calls after Deregister, got %d", calls)
+	}
+}
+
+// TestSchedulerCleanoutNowBeforeRegister guards the chunk0-3 fix:
+// CleanoutNow used to hang forever if called before any folder had
+// ever Register()ed, since nothing was running to receive on trigger
+// or close stop.
+func TestSchedulerCleanoutNowBeforeRegister(t *testing.T) {
+	s := NewScheduler()
+	defer s.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		s.CleanoutNow("never-registered")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("CleanoutNow hung when called before any Register")
+	}
+}
+
+func TestSchedulerCleanoutAllRespectsConcurrencyCap(t *testing.T) {
+	s := NewScheduler()
+	defer s.Stop()
+
+	release := make(chan struct{})
+	var running, maxRunning int32
+	var mut sync.Mutex
+
+	const folders = maxConcurrentCleanouts + 2
+	for i := 0; i < folders; i++ {
+		id := string(rune('a' + i))
+		s.Register(id, func() error {
+			n := atomic.AddInt32(&running, 1)
+			mut.Lock()
+			if n > maxRunning {
+				maxRunning = n
+			}
+			mut.Unlock()
+			<-release
+			atomic.AddInt32(&running, -1)
+			return nil
+		})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.cleanoutAll()
+		close(done)
+	}()
+
+	// Give every goroutine the cleanoutAll semaphore allows a chance to
+	// start, then release them all and wait for completion.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	<-done
+
+	mut.Lock()
+	defer mut.Unlock()
+	if maxRunning > maxConcurrentCleanouts {
+		t.Fatalf("observed %d concurrent cleanouts, want at most %d", maxRunning, maxConcurrentCleanouts)
+	}
+	if maxRunning == 0 {
+		t.Fatal("no cleanout ever ran")
+	}
+}
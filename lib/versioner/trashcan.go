@@ -7,9 +7,14 @@
 package versioner
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/syncthing/syncthing/lib/fs"
@@ -21,26 +26,76 @@ func init() {
 	Factories["trashcan"] = NewTrashcan
 }
 
+const versionsDir = ".stversions"
+
+var errVersionNotFound = errors.New("versioner: no such version")
+
 type Trashcan struct {
-	filesystem   fs.Filesystem
-	cleanoutDays int
-	stop         chan struct{}
+	folderID   string
+	filesystem fs.Filesystem
+	policy     RetentionPolicy
+	encryptor  *encryptor
 }
 
+// NewTrashcan configures a Trashcan from the "params" map of a folder's
+// versioning configuration. Recognized keys:
+//
+//	cleanoutDays   - age-based cutoff in days (the historical default)
+//	cleanoutPolicy - "age" (default), "staggered" or "sizeCap"
+//	maxSizeMiB     - budget for the "sizeCap" policy
+//	encrypt        - "true" to encrypt archived content at rest
+//	passphrase     - passphrase to derive the encryption key from
+//	keyfile        - path to a file holding the passphrase, as an
+//	                 alternative to passphrase
+//
+// With no recognized parameters, the trash can is never cleaned out.
+//
+// The returned Trashcan registers its cleanout with DefaultScheduler
+// instead of running its own timer, so that dozens of folders sharing
+// a process don't each thrash the disk on an independent 24h cycle.
 func NewTrashcan(folderID string, filesystem fs.Filesystem, params map[string]string) Versioner {
-	cleanoutDays, _ := strconv.Atoi(params["cleanoutDays"])
-	// On error we default to 0, "do not clean out the trash can"
+	enc, err := newEncryptor(filesystem, params)
+	if err != nil {
+		// encrypt=true was requested and key setup failed (bad
+		// passphrase, unreadable keyfile, or an existing .index that
+		// won't decrypt with it). Falling back to plaintext archiving
+		// here would silently defeat the whole point of the feature,
+		// so this folder's versioner refuses to do anything at all
+		// until the configuration is fixed.
+		l.Warnln("Versioner: refusing to archive in plaintext, encryption setup failed:", err)
+		return &erroringVersioner{err: fmt.Errorf("versioner: encryption unavailable: %w", err)}
+	}
 
 	s := &Trashcan{
-		filesystem:   filesystem,
-		cleanoutDays: cleanoutDays,
-		stop:         make(chan struct{}),
+		folderID:   folderID,
+		filesystem: filesystem,
+		policy:     retentionPolicyFromParams(params),
+		encryptor:  enc,
 	}
 
+	DefaultScheduler.Register(folderID, s.cleanoutArchive)
+
 	l.Debugf("instantiated %#v", s)
 	return s
 }
 
+// retentionPolicyFromParams picks and configures a RetentionPolicy
+// according to the versioner's "params" map. On unrecognized or missing
+// configuration it falls back to the age-based policy keyed off
+// cleanoutDays (which may itself be zero, i.e. "never clean out").
+func retentionPolicyFromParams(params map[string]string) RetentionPolicy {
+	switch params["cleanoutPolicy"] {
+	case "staggered":
+		return &StaggeredRetentionPolicy{}
+	case "sizeCap":
+		return &SizeCapRetentionPolicy{MaxBytes: parseMiB(params["maxSizeMiB"])}
+	default:
+		cleanoutDays, _ := strconv.Atoi(params["cleanoutDays"])
+		// On error we default to 0, "do not clean out the trash can"
+		return &AgeRetentionPolicy{MaxAge: time.Duration(cleanoutDays) * 24 * time.Hour}
+	}
+}
+
 // Archive moves the named file away to a version archive. If this function
 // returns nil, the named file does not exist any more (has been archived).
 func (t *Trashcan) Archive(filePath string) error {
@@ -55,7 +110,6 @@ func (t *Trashcan) Archive(filePath string) error {
 		panic("bug: attempting to version a symlink")
 	}
 
-	versionsDir := ".stversions"
 	if _, err := t.filesystem.Stat(versionsDir); err != nil {
 		if !fs.IsNotExist(err) {
 			return err
@@ -70,7 +124,16 @@ func (t *Trashcan) Archive(filePath string) error {
 
 	l.Debugln("archiving", filePath)
 
-	archivedPath := filepath.Join(versionsDir, filePath)
+	ts := time.Now()
+	archivedPath := archivedPathFor(filePath, ts)
+
+	if t.encryptor != nil {
+		if err := t.archiveEncrypted(filePath, archivedPath, ts); err != nil {
+			return err
+		}
+		return t.filesystem.Remove(filePath)
+	}
+
 	if err := t.filesystem.MkdirAll(filepath.Dir(archivedPath), 0777); err != nil && !fs.IsExist(err) {
 		return err
 	}
@@ -84,90 +147,303 @@ func (t *Trashcan) Archive(filePath string) error {
 	// Set the mtime to the time the file was deleted. This is used by the
 	// cleanout routine. If this fails things won't work optimally but there's
 	// not much we can do about it so we ignore the error.
-	t.filesystem.Chtimes(archivedPath, time.Now(), time.Now())
+	t.filesystem.Chtimes(archivedPath, ts, ts)
 
 	return nil
 }
 
-func (t *Trashcan) Serve() {
-	l.Debugln(t, "starting")
-	defer l.Debugln(t, "stopping")
-
-	// Do the first cleanup one minute after startup.
-	timer := time.NewTimer(time.Minute)
-	defer timer.Stop()
-
-	for {
-		select {
-		case <-t.stop:
-			return
-
-		case <-timer.C:
-			if t.cleanoutDays > 0 {
-				if err := t.cleanoutArchive(); err != nil {
-					l.Infoln("Cleaning trashcan:", err)
-				}
-			}
+// archiveEncrypted seals filePath's content under the configured
+// encryptor and writes it to the obfuscated location on disk recorded
+// for archivedPath in the encryptor's name index. The caller is
+// responsible for removing filePath afterwards.
+func (t *Trashcan) archiveEncrypted(filePath, archivedPath string, ts time.Time) error {
+	src, err := t.filesystem.Open(filePath)
+	if err != nil {
+		return err
+	}
+	plaintext, err := ioutil.ReadAll(src)
+	src.Close()
+	if err != nil {
+		return err
+	}
 
-			// Cleanups once a day should be enough.
-			timer.Reset(24 * time.Hour)
-		}
+	// archivedPath (the logical, unobfuscated path) is bound in as
+	// associated data so a node with filesystem access to nothing but
+	// versionsDir can't swap two archived versions' ciphertext on disk
+	// and have both decrypt successfully with their content exchanged.
+	ciphertext, err := t.encryptor.encrypt(plaintext, []byte(archivedPath))
+	if err != nil {
+		return err
+	}
+
+	physicalPath, err := t.encryptor.register(archivedPath)
+	if err != nil {
+		return err
+	}
+
+	l.Debugln("moving to", physicalPath, "(encrypted)")
+
+	out, err := t.filesystem.Create(physicalPath)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(ciphertext); err != nil {
+		out.Close()
+		return err
 	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	t.filesystem.Chtimes(physicalPath, ts, ts)
+	return nil
+}
+
+// archivedPathFor returns the path, under versionsDir, that filePath
+// should be archived to for a version taken at ts. The timestamp is
+// tagged onto the file name (name~YYYYMMDD-HHMMSS.ext) so that repeated
+// archival of the same original path does not overwrite earlier
+// versions.
+func archivedPathFor(filePath string, ts time.Time) string {
+	return filepath.Join(versionsDir, TagFilename(filePath, ts.Format(TimeFormat)))
+}
+
+// Serve is a no-op: cleanout is driven by DefaultScheduler, which
+// Trashcan registered with in NewTrashcan. It exists to satisfy the
+// Versioner interface.
+func (t *Trashcan) Serve() {
 }
 
+// Stop deregisters this Trashcan's cleanout from DefaultScheduler.
 func (t *Trashcan) Stop() {
-	close(t.stop)
+	DefaultScheduler.Deregister(t.folderID)
 }
 
 func (t *Trashcan) String() string {
 	return fmt.Sprintf("trashcan@%p", t)
 }
 
-func (t *Trashcan) cleanoutArchive() error {
-	versionsDir := ".stversions"
+// allVersions returns a FileVersion for every archived file, resolving
+// the encrypted name index instead of walking the tree if this
+// Trashcan is configured with encrypt=true (archived file names on
+// disk are obfuscated and don't reflect the original tree). It returns
+// a nil slice, not an error, if there is nothing archived yet.
+func (t *Trashcan) allVersions() ([]FileVersion, error) {
+	if t.encryptor != nil {
+		return t.allVersionsEncrypted()
+	}
+
 	if _, err := t.filesystem.Lstat(versionsDir); fs.IsNotExist(err) {
-		return nil
+		return nil, nil
 	}
 
-	cutoff := time.Now().Add(time.Duration(-24*t.cleanoutDays) * time.Hour)
-	currentDir := ""
-	filesInDir := 0
+	var versions []FileVersion
 	walkFn := func(path string, info fs.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-
 		if info.IsDir() {
-			// We have entered a new directory. Lets check if the previous
-			// directory was empty and try to remove it. We ignore failure for
-			// the time being.
-			if currentDir != "" && filesInDir == 0 {
-				t.filesystem.Remove(currentDir)
-			}
-			currentDir = path
-			filesInDir = 0
 			return nil
 		}
+		versions = append(versions, newFileVersion(path, info))
+		return nil
+	}
+	if err := t.filesystem.Walk(versionsDir, walkFn); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
 
-		if info.ModTime().Before(cutoff) {
-			// The file is too old; remove it.
-			t.filesystem.Remove(path)
-		} else {
-			// Keep this file, and remember it so we don't unnecessarily try
-			// to remove this directory.
-			filesInDir++
+func (t *Trashcan) allVersionsEncrypted() ([]FileVersion, error) {
+	var versions []FileVersion
+	for obf, archivedPath := range t.encryptor.entries() {
+		info, err := t.filesystem.Lstat(filepath.Join(versionsDir, obf))
+		if fs.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
 		}
-		return nil
+		versions = append(versions, newFileVersion(archivedPath, info))
 	}
+	return versions, nil
+}
 
-	if err := t.filesystem.Walk(versionsDir, walkFn); err != nil {
+// List returns every archived version whose original path starts with
+// prefix ("" lists everything).
+func (t *Trashcan) List(prefix string) ([]FileVersion, error) {
+	versions, err := t.allVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix == "" {
+		return versions, nil
+	}
+
+	filtered := versions[:0]
+	for _, v := range versions {
+		if strings.HasPrefix(v.OriginalPath, prefix) {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered, nil
+}
+
+// Get returns the contents of the version of filePath that was
+// archived at versionTime. The caller must Close the result.
+func (t *Trashcan) Get(filePath string, versionTime time.Time) (io.ReadCloser, error) {
+	archivedPath := archivedPathFor(filePath, versionTime)
+	if t.encryptor == nil {
+		return t.filesystem.Open(archivedPath)
+	}
+
+	physicalPath, ok := t.encryptor.physicalPath(archivedPath)
+	if !ok {
+		return nil, errVersionNotFound
+	}
+	f, err := t.filesystem.Open(physicalPath)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := t.encryptor.decrypt(ciphertext, []byte(archivedPath))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(plaintext)), nil
+}
+
+// Restore moves the archived version of filePath taken at versionTime
+// back into the folder, overwriting whatever is there now. If a file
+// currently exists at filePath it is archived first, so a Restore can
+// itself be undone.
+func (t *Trashcan) Restore(filePath string, versionTime time.Time) error {
+	if t.encryptor != nil {
+		return t.restoreEncrypted(filePath, versionTime)
+	}
+
+	archivedPath := archivedPathFor(filePath, versionTime)
+	if _, err := t.filesystem.Lstat(archivedPath); err != nil {
+		return err
+	}
+
+	if _, err := t.filesystem.Lstat(filePath); err == nil {
+		if err := t.Archive(filePath); err != nil {
+			return err
+		}
+	} else if !fs.IsNotExist(err) {
+		return err
+	}
+
+	if err := t.filesystem.MkdirAll(filepath.Dir(filePath), 0777); err != nil && !fs.IsExist(err) {
+		return err
+	}
+
+	return osutil.Rename(t.filesystem, archivedPath, filePath)
+}
+
+func (t *Trashcan) restoreEncrypted(filePath string, versionTime time.Time) error {
+	rc, err := t.Get(filePath, versionTime)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if _, err := t.filesystem.Lstat(filePath); err == nil {
+		if err := t.Archive(filePath); err != nil {
+			return err
+		}
+	} else if !fs.IsNotExist(err) {
 		return err
 	}
 
-	// The last directory seen by the walkFn may not have been removed as it
-	// should be.
-	if currentDir != "" && filesInDir == 0 {
-		t.filesystem.Remove(currentDir)
+	if err := t.filesystem.MkdirAll(filepath.Dir(filePath), 0777); err != nil && !fs.IsExist(err) {
+		return err
+	}
+
+	out, err := t.filesystem.Create(filePath)
+	if err != nil {
+		return err
 	}
+	if _, err := io.Copy(out, rc); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	t.removeVersion(FileVersion{ArchivePath: archivedPathFor(filePath, versionTime)})
 	return nil
 }
+
+// cleanoutArchive collects every archived version (see allVersions), asks the configured
+// RetentionPolicy which versions to keep, and removes everything else,
+// along with any directory this leaves empty.
+func (t *Trashcan) cleanoutArchive() error {
+	versions, err := t.allVersions()
+	if err != nil {
+		return err
+	}
+	if versions == nil {
+		return nil
+	}
+
+	keep := make(map[string]struct{})
+	for _, path := range t.policy.Retain(versions) {
+		keep[path] = struct{}{}
+	}
+
+	// An encrypted archive stores every version flat, under an
+	// obfuscated name directly in versionsDir, so there are no
+	// per-original-file directories to prune afterwards.
+	filesInDir := make(map[string]int)
+	for _, v := range versions {
+		if _, ok := keep[v.ArchivePath]; ok {
+			if t.encryptor == nil {
+				filesInDir[filepath.Dir(v.ArchivePath)]++
+			}
+			continue
+		}
+		t.removeVersion(v)
+		if t.encryptor == nil {
+			dir := filepath.Dir(v.ArchivePath)
+			if _, ok := filesInDir[dir]; !ok {
+				filesInDir[dir] = 0
+			}
+		}
+	}
+
+	// Remove any directory under versionsDir that no longer holds a kept
+	// version. Failures are ignored. Only directories that held a version
+	// in this pass are considered, so an empty directory left behind is
+	// not revisited by later cleanouts.
+	for dir, n := range filesInDir {
+		if n == 0 {
+			t.filesystem.Remove(dir)
+		}
+	}
+
+	return nil
+}
+
+// removeVersion deletes the on-disk storage backing v. For an
+// encrypted archive this also forgets v's entry in the encryptor's
+// name index.
+func (t *Trashcan) removeVersion(v FileVersion) {
+	if t.encryptor == nil {
+		t.filesystem.Remove(v.ArchivePath)
+		return
+	}
+
+	if physicalPath, ok := t.encryptor.physicalPath(v.ArchivePath); ok {
+		t.filesystem.Remove(physicalPath)
+	}
+	if err := t.encryptor.forget(v.ArchivePath); err != nil {
+		l.Infoln("Forgetting archived version:", err)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package versioner
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TimeFormat is used throughout the versioner package to tag archived
+// files with the time they were versioned.
+const TimeFormat = "20060102-150405"
+
+// TagFilename inserts "~tag" just before the extension of name, e.g.
+// TagFilename("foo/bar.txt", "20060102-150405") returns
+// "foo/bar~20060102-150405.txt".
+func TagFilename(name, tag string) string {
+	dir, file := filepath.Split(name)
+	ext := filepath.Ext(file)
+	withoutExt := file[:len(file)-len(ext)]
+	return filepath.Join(dir, withoutExt+"~"+tag+ext)
+}
+
+// UntagFilename splits a name produced by TagFilename back into the
+// original file path and the tag. If name does not look tagged, ok is
+// false and orig equals name.
+func UntagFilename(name string) (orig, tag string, ok bool) {
+	dir, file := filepath.Split(name)
+	ext := filepath.Ext(file)
+	withoutExt := file[:len(file)-len(ext)]
+
+	idx := strings.LastIndex(withoutExt, "~")
+	if idx == -1 {
+		return name, "", false
+	}
+
+	tag = withoutExt[idx+1:]
+	if _, err := time.Parse(TimeFormat, tag); err != nil {
+		return name, "", false
+	}
+
+	return filepath.Join(dir, withoutExt[:idx]+ext), tag, true
+}